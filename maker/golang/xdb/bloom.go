@@ -0,0 +1,145 @@
+// Copyright 2022 The Ip2Region Authors. All rights reserved.
+// Use of this source code is governed by a Apache2.0-style
+// license that can be found in the LICENSE file.
+
+// ----
+// bloom filter (negative lookup) block
+//
+// borrows the filter-block idea from the LevelDB SSTable layout: one small
+// Bloom filter per populated vectorIndex[i][j] super block, built over the
+// /24 prefixes that super block's segment index range covers. a 256x256x4
+// byte directory (one file-offset per super block, 0 meaning "no filter")
+// sits right after the vector index, immediately before the filter bodies
+// themselves; the data payload and segment index follow after that.
+//
+// a v3-unaware (or filter-unaware) searcher just never reads this block -
+// WithBloomFilter's bitsPerKey is recorded in the header purely so a
+// filter-aware searcher can tell whether it's there at all before doing
+// the binary search on the segment index.
+
+package xdb
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+)
+
+const filterDirectoryEntrySize = 4
+const filterDirectoryLength = VectorIndexRows * VectorIndexCols * filterDirectoryEntrySize
+
+// bloomFilter is a fixed-size Bloom filter whose k probe positions are
+// derived from a single 64-bit hash via double hashing (h1 + i*h2), instead
+// of paying for k independent hash functions.
+type bloomFilter struct {
+	bits []byte
+	k    int
+}
+
+// newBloomFilter sizes a filter for numKeys entries at roughly bitsPerKey
+// bits/key, picking k = ln(2) * bitsPerKey the usual way.
+func newBloomFilter(bitsPerKey int, numKeys int) *bloomFilter {
+	if bitsPerKey < 1 {
+		bitsPerKey = 10
+	}
+
+	var k = int(float64(bitsPerKey) * 0.69)
+	if k < 1 {
+		k = 1
+	}
+	if k > 30 {
+		k = 30
+	}
+
+	var nBits = numKeys * bitsPerKey
+	if nBits < 64 {
+		nBits = 64
+	}
+
+	return &bloomFilter{bits: make([]byte, (nBits+7)/8), k: k}
+}
+
+func (f *bloomFilter) hashes(key []byte) (uint64, uint64) {
+	var h = fnv.New64a()
+	_, _ = h.Write(key)
+	var h1 = h.Sum64()
+	// an odd multiplier keeps h2 nonzero and decorrelated from h1.
+	var h2 = h1*0x9E3779B97F4A7C15 + 1
+	return h1, h2
+}
+
+func (f *bloomFilter) add(key []byte) {
+	var nBits = uint64(len(f.bits) * 8)
+	h1, h2 := f.hashes(key)
+	for i := 0; i < f.k; i++ {
+		var bitPos = (h1 + uint64(i)*h2) % nBits
+		f.bits[bitPos/8] |= 1 << (bitPos % 8)
+	}
+}
+
+// mayContain reports whether key could be a member: false is certain, true
+// is a (possibly false) maybe.
+func (f *bloomFilter) mayContain(key []byte) bool {
+	var nBits = uint64(len(f.bits) * 8)
+	h1, h2 := f.hashes(key)
+	for i := 0; i < f.k; i++ {
+		var bitPos = (h1 + uint64(i)*h2) % nBits
+		if f.bits[bitPos/8]&(1<<(bitPos%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// superBlockKey identifies a vectorIndex[i][j] super block.
+type superBlockKey struct {
+	row uint8
+	col uint8
+}
+
+// WithBloomFilter turns on the negative-lookup filter block: bitsPerKey is
+// the Bloom filter's bits/key budget (larger means fewer false positives,
+// at the cost of a bigger filter block). the default (never calling this)
+// leaves the filter block out entirely.
+func (m *Maker) WithBloomFilter(bitsPerKey int) *Maker {
+	m.bloomBitsPerKey = bitsPerKey
+	return m
+}
+
+// buildSuperBlockFilters groups the /24 prefixes of every segment by the
+// same (row, col) = ((ip>>24)&0xFF, (ip>>16)&0xFF) pair setVectorIndex keys
+// its super blocks with, then builds one Bloom filter per populated pair.
+func (m *Maker) buildSuperBlockFilters() map[superBlockKey]*bloomFilter {
+	var prefixes = map[superBlockKey]map[uint32]bool{}
+
+	for _, seg := range m.segments {
+		for _, s := range seg.Split() {
+			var key = superBlockKey{row: uint8((s.StartIP >> 24) & 0xFF), col: uint8((s.StartIP >> 16) & 0xFF)}
+
+			var set = prefixes[key]
+			if set == nil {
+				set = map[uint32]bool{}
+				prefixes[key] = set
+			}
+
+			for p := s.StartIP >> 8; ; p++ {
+				set[p] = true
+				if p >= s.EndIP>>8 {
+					break
+				}
+			}
+		}
+	}
+
+	var filters = make(map[superBlockKey]*bloomFilter, len(prefixes))
+	for key, set := range prefixes {
+		var f = newBloomFilter(m.bloomBitsPerKey, len(set))
+		for p := range set {
+			var buf = make([]byte, 4)
+			binary.BigEndian.PutUint32(buf, p)
+			f.add(buf)
+		}
+		filters[key] = f
+	}
+
+	return filters
+}
@@ -0,0 +1,54 @@
+// Copyright 2022 The Ip2Region Authors. All rights reserved.
+// Use of this source code is governed by a Apache2.0-style
+// license that can be found in the LICENSE file.
+
+package xdb
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestBloomFilterNoFalseNegatives(t *testing.T) {
+	var f = newBloomFilter(10, 1000)
+
+	var keys = make([][]byte, 0, 1000)
+	for i := uint32(0); i < 1000; i++ {
+		var key = make([]byte, 4)
+		binary.BigEndian.PutUint32(key, i)
+		keys = append(keys, key)
+		f.add(key)
+	}
+
+	for _, key := range keys {
+		if !f.mayContain(key) {
+			t.Fatalf("mayContain(%x) = false, want true (false negatives are not allowed)", key)
+		}
+	}
+}
+
+func TestBloomFilterMostlyRejectsAbsentKeys(t *testing.T) {
+	var f = newBloomFilter(10, 1000)
+
+	for i := uint32(0); i < 1000; i++ {
+		var key = make([]byte, 4)
+		binary.BigEndian.PutUint32(key, i)
+		f.add(key)
+	}
+
+	var falsePositives int
+	const probes = 10000
+	for i := uint32(1_000_000); i < 1_000_000+probes; i++ {
+		var key = make([]byte, 4)
+		binary.BigEndian.PutUint32(key, i)
+		if f.mayContain(key) {
+			falsePositives++
+		}
+	}
+
+	// at 10 bits/key the false positive rate should be close to 1%; leave
+	// a lot of headroom so this isn't flaky, just a sanity bound.
+	if falsePositives > probes/10 {
+		t.Fatalf("false positive rate too high: %d/%d", falsePositives, probes)
+	}
+}
@@ -0,0 +1,206 @@
+// Copyright 2022 The Ip2Region Authors. All rights reserved.
+// Use of this source code is governed by a Apache2.0-style
+// license that can be found in the LICENSE file.
+
+// ----
+// optional payload compression
+//
+// the data payload region (between the vector index and the segment index)
+// can optionally be written as a sequence of independently decompressible
+// chunks instead of one flat run of region strings. each chunk holds as
+// many whole region entries as fit under WithPayloadCodec's chunkSize, and
+// is compressed on its own so a searcher only ever has to inflate the one
+// chunk that contains the region it's after - never the whole payload.
+//
+// layout when a codec is set:
+// +----------------+-------------------+---------------+---------------+--------------+
+// | header space   | speed up index    | compressed    | chunk TOC     | segment      |
+// |                |                   | payload chunks|               | index block  |
+// +----------------+-------------------+---------------+---------------+--------------+
+//
+// the TOC is a flat array of chunkTocEntry, one per chunk, in chunk-id
+// order. its file offset and the codec id both live in the header so a
+// searcher can tell at a glance whether it needs to look for it at all -
+// CodecNone keeps the exact v2/v3 layout and is fully backward compatible.
+
+package xdb
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// PayloadCodec selects how (if at all) the data payload is compressed.
+// mirrors IndexPolicy's plain-int, header-carried style.
+type PayloadCodec int
+
+const (
+	CodecNone PayloadCodec = iota
+	CodecGzip
+)
+
+func (c PayloadCodec) String() string {
+	switch c {
+	case CodecNone:
+		return "none"
+	case CodecGzip:
+		return "gzip"
+	default:
+		return "unknown"
+	}
+}
+
+// CompressedVersionFlag is OR'd into the header version word whenever the
+// payload is chunked, so a searcher can tell from the version alone (before
+// it even reaches the codec byte) that it must resolve a TOC.
+const CompressedVersionFlag = 0x8000
+
+// DefaultChunkSize is used by WithPayloadCodec when chunkSize <= 0.
+const DefaultChunkSize = 64 * 1024
+
+// chunkTocEntry is one row of the chunk table of contents: chunk-id is
+// implicit in its position in the TOC array.
+type chunkTocEntry struct {
+	Offset  uint32 // file offset of the compressed chunk
+	CompLen uint32 // compressed length in bytes
+	RawLen  uint32 // uncompressed length in bytes
+}
+
+const chunkTocEntrySize = 4 + 4 + 4
+
+func (e *chunkTocEntry) Encode() []byte {
+	var buff = make([]byte, chunkTocEntrySize)
+	binary.LittleEndian.PutUint32(buff, e.Offset)
+	binary.LittleEndian.PutUint32(buff[4:], e.CompLen)
+	binary.LittleEndian.PutUint32(buff[8:], e.RawLen)
+	return buff
+}
+
+// chunkPtrBits is how many low bits of a DataPtr hold the in-chunk byte
+// offset; the remaining high bits hold the chunk id, i.e.
+// DataPtr = (chunkID << chunkPtrBits) | chunkOffset.
+const chunkPtrBits = 20
+const chunkOffsetMask = 1<<chunkPtrBits - 1
+
+func encodeChunkPtr(chunkID uint32, offset uint32) (uint32, error) {
+	if offset > chunkOffsetMask {
+		return 0, fmt.Errorf("chunk offset %d exceeds %d bits", offset, chunkPtrBits)
+	}
+	return (chunkID << chunkPtrBits) | offset, nil
+}
+
+func decodeChunkPtr(ptr uint32) (chunkID uint32, offset uint32) {
+	return ptr >> chunkPtrBits, ptr & chunkOffsetMask
+}
+
+// WithPayloadCodec turns on chunked payload compression: regions are
+// buffered into chunkSize-ish chunks and each chunk is compressed with
+// codec before being written. the default (never calling this, or calling
+// it with CodecNone) keeps writing the flat, uncompressed payload Start
+// always has.
+func (m *Maker) WithPayloadCodec(codec PayloadCodec, chunkSize int) *Maker {
+	m.payloadCodec = codec
+	if chunkSize <= 0 {
+		chunkSize = DefaultChunkSize
+	}
+	m.chunkSize = chunkSize
+	return m
+}
+
+// payloadChunker accumulates region bytes into chunks and flushes each full
+// chunk to dst as a compressed block, recording a TOC entry per chunk.
+type payloadChunker struct {
+	codec     PayloadCodec
+	chunkSize int
+	buf       bytes.Buffer
+	toc       []chunkTocEntry
+}
+
+func newPayloadChunker(codec PayloadCodec, chunkSize int) *payloadChunker {
+	return &payloadChunker{codec: codec, chunkSize: chunkSize}
+}
+
+// add appends region to the current chunk, flushing first if region would
+// overflow chunkSize. returns the chunk id and in-chunk byte offset the
+// region was (or will be, post-flush) written at.
+func (c *payloadChunker) add(dst io.WriteSeeker, region []byte) (chunkID uint32, offset uint32, err error) {
+	if c.buf.Len() > 0 && c.buf.Len()+len(region) > c.chunkSize {
+		if err = c.flush(dst); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	offset = uint32(c.buf.Len())
+	chunkID = uint32(len(c.toc))
+	c.buf.Write(region)
+	return chunkID, offset, nil
+}
+
+// flush compresses and writes out the current chunk, appending its TOC
+// entry. a no-op when nothing has been buffered.
+func (c *payloadChunker) flush(dst io.WriteSeeker) error {
+	if c.buf.Len() == 0 {
+		return nil
+	}
+
+	raw := c.buf.Bytes()
+	compressed, err := compressChunk(c.codec, raw)
+	if err != nil {
+		return fmt.Errorf("compress chunk %d: %w", len(c.toc), err)
+	}
+
+	pos, err := dst.Seek(0, 1)
+	if err != nil {
+		return fmt.Errorf("seek to chunk %d start: %w", len(c.toc), err)
+	}
+
+	if _, err = dst.Write(compressed); err != nil {
+		return fmt.Errorf("write chunk %d: %w", len(c.toc), err)
+	}
+
+	c.toc = append(c.toc, chunkTocEntry{
+		Offset:  uint32(pos),
+		CompLen: uint32(len(compressed)),
+		RawLen:  uint32(len(raw)),
+	})
+	c.buf.Reset()
+	return nil
+}
+
+func decompressChunk(codec PayloadCodec, compressed []byte) ([]byte, error) {
+	switch codec {
+	case CodecNone:
+		return compressed, nil
+	case CodecGzip:
+		r, err := gzip.NewReader(bytes.NewReader(compressed))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return io.ReadAll(r)
+	default:
+		return nil, fmt.Errorf("unknown payload codec %d", codec)
+	}
+}
+
+func compressChunk(codec PayloadCodec, raw []byte) ([]byte, error) {
+	switch codec {
+	case CodecNone:
+		return raw, nil
+	case CodecGzip:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(raw); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	default:
+		return nil, fmt.Errorf("unknown payload codec %d", codec)
+	}
+}
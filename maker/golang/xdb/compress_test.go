@@ -0,0 +1,157 @@
+// Copyright 2022 The Ip2Region Authors. All rights reserved.
+// Use of this source code is governed by a Apache2.0-style
+// license that can be found in the LICENSE file.
+
+package xdb
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+// seekableBuffer is a minimal in-memory io.WriteSeeker, standing in for
+// *os.File in tests that exercise payloadChunker without touching disk.
+type seekableBuffer struct {
+	data []byte
+	pos  int64
+}
+
+func newSeekableBuffer() *seekableBuffer {
+	return &seekableBuffer{}
+}
+
+func (b *seekableBuffer) Write(p []byte) (int, error) {
+	var end = int(b.pos) + len(p)
+	if end > len(b.data) {
+		var grown = make([]byte, end)
+		copy(grown, b.data)
+		b.data = grown
+	}
+	copy(b.data[b.pos:], p)
+	b.pos = int64(end)
+	return len(p), nil
+}
+
+func (b *seekableBuffer) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case 0:
+		b.pos = offset
+	case 1:
+		b.pos += offset
+	case 2:
+		b.pos = int64(len(b.data)) + offset
+	default:
+		return 0, fmt.Errorf("unknown whence %d", whence)
+	}
+	return b.pos, nil
+}
+
+func TestChunkPtrRoundTrip(t *testing.T) {
+	var cases = []struct {
+		chunkID uint32
+		offset  uint32
+	}{
+		{0, 0},
+		{1, 123},
+		{255, chunkOffsetMask},
+		{1 << 11, 42},
+	}
+
+	for _, c := range cases {
+		ptr, err := encodeChunkPtr(c.chunkID, c.offset)
+		if err != nil {
+			t.Fatalf("encodeChunkPtr(%d, %d): %v", c.chunkID, c.offset, err)
+		}
+
+		gotID, gotOffset := decodeChunkPtr(ptr)
+		if gotID != c.chunkID || gotOffset != c.offset {
+			t.Fatalf("decodeChunkPtr(%d) = (%d, %d), want (%d, %d)", ptr, gotID, gotOffset, c.chunkID, c.offset)
+		}
+	}
+}
+
+func TestEncodeChunkPtrRejectsOversizeOffset(t *testing.T) {
+	if _, err := encodeChunkPtr(0, chunkOffsetMask+1); err == nil {
+		t.Fatalf("expected an error for an offset past chunkOffsetMask")
+	}
+}
+
+func TestGzipChunkRoundTrip(t *testing.T) {
+	var raw = []byte("China|Guangdong|Shenzhen|Telecom")
+
+	compressed, err := compressChunk(CodecGzip, raw)
+	if err != nil {
+		t.Fatalf("compressChunk: %v", err)
+	}
+
+	decoded, err := decompressChunk(CodecGzip, compressed)
+	if err != nil {
+		t.Fatalf("decompressChunk: %v", err)
+	}
+
+	if !bytes.Equal(decoded, raw) {
+		t.Fatalf("decompressChunk(compressChunk(raw)) = %q, want %q", decoded, raw)
+	}
+}
+
+func TestCodecNoneIsANoOp(t *testing.T) {
+	var raw = []byte("some region string")
+
+	compressed, err := compressChunk(CodecNone, raw)
+	if err != nil {
+		t.Fatalf("compressChunk(CodecNone): %v", err)
+	}
+	if !bytes.Equal(compressed, raw) {
+		t.Fatalf("compressChunk(CodecNone) modified the bytes")
+	}
+
+	decoded, err := decompressChunk(CodecNone, compressed)
+	if err != nil {
+		t.Fatalf("decompressChunk(CodecNone): %v", err)
+	}
+	if !bytes.Equal(decoded, raw) {
+		t.Fatalf("decompressChunk(CodecNone) modified the bytes")
+	}
+}
+
+func TestPayloadChunkerFlushesOnOverflow(t *testing.T) {
+	var buf = newSeekableBuffer()
+	var c = newPayloadChunker(CodecNone, 8)
+
+	id0, off0, err := c.add(buf, []byte("abcd"))
+	if err != nil {
+		t.Fatalf("add #1: %v", err)
+	}
+
+	id1, off1, err := c.add(buf, []byte("efgh"))
+	if err != nil {
+		t.Fatalf("add #2: %v", err)
+	}
+
+	// "abcdefgh" is exactly chunkSize, still one chunk.
+	if id0 != id1 {
+		t.Fatalf("expected both regions in chunk 0, got %d and %d", id0, id1)
+	}
+	if off0 != 0 || off1 != 4 {
+		t.Fatalf("unexpected offsets: %d, %d", off0, off1)
+	}
+
+	id2, off2, err := c.add(buf, []byte("ijkl"))
+	if err != nil {
+		t.Fatalf("add #3: %v", err)
+	}
+	if id2 == id0 {
+		t.Fatalf("expected a new chunk once chunkSize would be exceeded")
+	}
+	if off2 != 0 {
+		t.Fatalf("expected the new chunk to start at offset 0, got %d", off2)
+	}
+
+	if err = c.flush(buf); err != nil {
+		t.Fatalf("final flush: %v", err)
+	}
+	if len(c.toc) != 2 {
+		t.Fatalf("expected 2 TOC entries, got %d", len(c.toc))
+	}
+}
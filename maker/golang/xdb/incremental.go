@@ -0,0 +1,297 @@
+// Copyright 2022 The Ip2Region Authors. All rights reserved.
+// Use of this source code is governed by a Apache2.0-style
+// license that can be found in the LICENSE file.
+
+// ----
+// incremental maker
+//
+// NewMaker always starts from a plain-text source and rewrites the whole
+// xdb from scratch. OpenMaker instead re-opens an existing AF_INET xdb,
+// reconstructs its in-memory Segment list from the segment index + payload,
+// and lets callers patch it with Upsert/Delete. those two only touch the
+// in-memory segment list and, for a genuinely new region string, append its
+// bytes past the real end of the file - the payload, any chunk TOC, and the
+// segment index all sit back-to-back with no gap, so "end of file" is the
+// only place free to grow into without clobbering live data. they never
+// rewrite the vector/segment index in place. Compact is what reclaims the
+// appended (and any now-dead) bytes and rebuilds the index from the final
+// segment list, the same way Start does for a from-scratch build.
+//
+// this lets an operator ship a small Upsert/Delete diff against a base xdb
+// instead of regenerating the whole multi-hundred-MB file every time a
+// handful of segments change.
+
+package xdb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+)
+
+// OpenMaker re-opens an existing AF_INET xdb file for incremental editing.
+// it is the Upsert/Delete/Compact counterpart of NewMaker: instead of
+// reading a plain-text source, it loads segments back out of dstFile.
+func OpenMaker(dstFile string) (*Maker, error) {
+	dstHandle, err := os.OpenFile(dstFile, os.O_RDWR, 0666)
+	if err != nil {
+		return nil, fmt.Errorf("open target file `%s`: %w", dstFile, err)
+	}
+
+	m := &Maker{
+		dstHandle:   dstHandle,
+		segments:    []*Segment{},
+		segments6:   []*Segment6{},
+		regionPool:  map[string]uint32{},
+		vectorIndex: [VectorIndexCols][VectorIndexRows]VectorIndexBlock{},
+	}
+
+	if err = m.loadFromFile(); err != nil {
+		_ = dstHandle.Close()
+		return nil, fmt.Errorf("load `%s`: %w", dstFile, err)
+	}
+
+	return m, nil
+}
+
+func (m *Maker) loadFromFile() error {
+	var header = make([]byte, HeaderInfoLength)
+	if _, err := m.dstHandle.ReadAt(header, 0); err != nil {
+		return fmt.Errorf("read header: %w", err)
+	}
+
+	var version = binary.LittleEndian.Uint16(header)
+	m.indexPolicy = IndexPolicy(binary.LittleEndian.Uint16(header[2:]))
+	var startIndexPtr = binary.LittleEndian.Uint32(header[8:])
+	var endIndexPtr = binary.LittleEndian.Uint32(header[12:])
+	m.family = AddressFamily(header[16])
+	m.payloadCodec = PayloadCodec(header[17])
+	var tocOffset = binary.LittleEndian.Uint32(header[20:])
+	m.bloomBitsPerKey = int(header[28])
+
+	if m.family == AF_INET6 {
+		return fmt.Errorf("OpenMaker only supports AF_INET xdbs for now, got version 0x%x", version)
+	}
+
+	if startIndexPtr == 0 && endIndexPtr == 0 {
+		// an empty/just-initialized db: nothing to load, appends start
+		// at the real end of the file (normally right after the vector
+		// index, since nothing else has been written yet).
+		fileEnd, err := m.dstHandle.Seek(0, 2)
+		if err != nil {
+			return fmt.Errorf("seek to end of file: %w", err)
+		}
+		m.appendOffset = fileEnd
+		return nil
+	}
+
+	var toc []chunkTocEntry
+	if m.payloadCodec != CodecNone {
+		var tocLen = (int64(startIndexPtr) - int64(tocOffset)) / chunkTocEntrySize
+		toc = make([]chunkTocEntry, 0, tocLen)
+		var buf = make([]byte, chunkTocEntrySize)
+		for i := int64(0); i < tocLen; i++ {
+			if _, err := m.dstHandle.ReadAt(buf, int64(tocOffset)+i*chunkTocEntrySize); err != nil {
+				return fmt.Errorf("read chunk TOC entry %d: %w", i, err)
+			}
+			toc = append(toc, chunkTocEntry{
+				Offset:  binary.LittleEndian.Uint32(buf),
+				CompLen: binary.LittleEndian.Uint32(buf[4:]),
+				RawLen:  binary.LittleEndian.Uint32(buf[8:]),
+			})
+		}
+	}
+
+	var chunkCache = map[uint32][]byte{}
+	var readRegion = func(dataPtr uint32, dataLen uint16) (string, error) {
+		if m.payloadCodec == CodecNone {
+			var buf = make([]byte, dataLen)
+			if _, err := m.dstHandle.ReadAt(buf, int64(dataPtr)); err != nil {
+				return "", fmt.Errorf("read region at %d: %w", dataPtr, err)
+			}
+			return string(buf), nil
+		}
+
+		chunkID, offset := decodeChunkPtr(dataPtr)
+		raw, has := chunkCache[chunkID]
+		if !has {
+			if int(chunkID) >= len(toc) {
+				return "", fmt.Errorf("chunk id %d out of range (%d chunks)", chunkID, len(toc))
+			}
+			var entry = toc[chunkID]
+			var compressed = make([]byte, entry.CompLen)
+			if _, err := m.dstHandle.ReadAt(compressed, int64(entry.Offset)); err != nil {
+				return "", fmt.Errorf("read chunk %d: %w", chunkID, err)
+			}
+			decoded, err := decompressChunk(m.payloadCodec, compressed)
+			if err != nil {
+				return "", fmt.Errorf("decompress chunk %d: %w", chunkID, err)
+			}
+			raw = decoded
+			chunkCache[chunkID] = raw
+		}
+
+		if int(offset)+int(dataLen) > len(raw) {
+			return "", fmt.Errorf("region (offset=%d, len=%d) overruns chunk %d (%d bytes)", offset, dataLen, chunkID, len(raw))
+		}
+		return string(raw[offset : int(offset)+int(dataLen)]), nil
+	}
+
+	// walk the segment index block, merging neighbouring entries that
+	// share a region back into the single Segment Segment.Split produced
+	// them from.
+	var last *Segment
+	for pos := int64(startIndexPtr); pos <= int64(endIndexPtr); pos += SegmentIndexBlockSize {
+		var buf = make([]byte, SegmentIndexBlockSize)
+		if _, err := m.dstHandle.ReadAt(buf, pos); err != nil {
+			return fmt.Errorf("read segment index at %d: %w", pos, err)
+		}
+
+		var sip = binary.LittleEndian.Uint32(buf)
+		var eip = binary.LittleEndian.Uint32(buf[4:])
+		var dataLen = binary.LittleEndian.Uint16(buf[8:])
+		var dataPtr = binary.LittleEndian.Uint32(buf[10:])
+
+		region, err := readRegion(dataPtr, dataLen)
+		if err != nil {
+			return fmt.Errorf("read region for segment [%d,%d]: %w", sip, eip, err)
+		}
+
+		if _, has := m.regionPool[region]; !has {
+			m.regionPool[region] = dataPtr
+		}
+
+		if last != nil && last.EndIP+1 == sip && last.Region == region {
+			last.EndIP = eip
+			continue
+		}
+
+		var seg = &Segment{StartIP: sip, EndIP: eip, Region: region}
+		m.segments = append(m.segments, seg)
+		last = seg
+	}
+
+	// the payload and segment index sit back-to-back with no gap (and, when
+	// chunked, the TOC and segment index do too) - startIndexPtr/tocOffset
+	// are the start of still-live data, not free space. the only place
+	// genuinely free for appendRegion to write is past the real end of the
+	// file.
+	fileEnd, err := m.dstHandle.Seek(0, 2)
+	if err != nil {
+		return fmt.Errorf("seek to end of file: %w", err)
+	}
+	m.appendOffset = fileEnd
+
+	return nil
+}
+
+// Upsert replaces whatever coverage [startIP, endIP] currently has with
+// region, splitting or dropping neighbouring segments as needed to keep the
+// segment list gap-free and non-overlapping. if region is already present
+// in the region pool its existing data pointer is reused; otherwise region
+// is appended past the real end of the file.
+func (m *Maker) Upsert(startIP, endIP uint32, region string) error {
+	if startIP > endIP {
+		return fmt.Errorf("start ip(%d) should not be greater than end ip(%d)", startIP, endIP)
+	}
+
+	m.segments = spliceSegments(m.segments, startIP, endIP, &Segment{StartIP: startIP, EndIP: endIP, Region: region})
+
+	if _, has := m.regionPool[region]; !has {
+		if err := m.appendRegion(region); err != nil {
+			return fmt.Errorf("append region `%s`: %w", region, err)
+		}
+	}
+
+	return nil
+}
+
+// Delete removes whatever coverage [startIP, endIP] currently has, leaving
+// a gap rather than replacing it with a new segment.
+func (m *Maker) Delete(startIP, endIP uint32) error {
+	if startIP > endIP {
+		return fmt.Errorf("start ip(%d) should not be greater than end ip(%d)", startIP, endIP)
+	}
+
+	m.segments = spliceSegments(m.segments, startIP, endIP, nil)
+	return nil
+}
+
+// spliceSegments removes the [startIP, endIP] range from segs, trimming any
+// segment that only partially overlaps it, and - if replacement is non-nil
+// - inserts it in the gap that leaves. segs is assumed sorted by StartIP.
+func spliceSegments(segs []*Segment, startIP, endIP uint32, replacement *Segment) []*Segment {
+	var result = make([]*Segment, 0, len(segs)+1)
+	var inserted = replacement == nil
+
+	for _, seg := range segs {
+		if seg.EndIP < startIP || seg.StartIP > endIP {
+			if !inserted && seg.StartIP > endIP {
+				result = append(result, replacement)
+				inserted = true
+			}
+			result = append(result, seg)
+			continue
+		}
+
+		// seg overlaps [startIP, endIP]: keep whatever sticks out on
+		// either side and drop the rest.
+		if seg.StartIP < startIP {
+			result = append(result, &Segment{StartIP: seg.StartIP, EndIP: startIP - 1, Region: seg.Region})
+		}
+		if !inserted {
+			result = append(result, replacement)
+			inserted = true
+		}
+		if seg.EndIP > endIP {
+			result = append(result, &Segment{StartIP: endIP + 1, EndIP: seg.EndIP, Region: seg.Region})
+		}
+	}
+
+	if !inserted {
+		result = append(result, replacement)
+	}
+
+	return result
+}
+
+// appendRegion writes region's bytes at the real end of the file and
+// records its pointer in the region pool. it does not touch the vector or
+// segment index - those are only rebuilt by Compact.
+func (m *Maker) appendRegion(region string) error {
+	var data = []byte(region)
+	if len(data) > 0xFFFF {
+		return fmt.Errorf("too long region info `%s`: should be less than %d bytes", region, 0xFFFF)
+	}
+
+	if _, err := m.dstHandle.WriteAt(data, m.appendOffset); err != nil {
+		return fmt.Errorf("write region at %d: %w", m.appendOffset, err)
+	}
+
+	m.regionPool[region] = uint32(m.appendOffset)
+	m.appendOffset += int64(len(data))
+	return nil
+}
+
+// Compact rewrites the xdb from the current in-memory segment list,
+// reclaiming whatever payload bytes Upsert/Delete left dangling and
+// rebuilding the vector and segment index from scratch - the same
+// algorithm Start uses for a from-scratch build.
+func (m *Maker) Compact() error {
+	if err := m.dstHandle.Truncate(0); err != nil {
+		return fmt.Errorf("truncate target file: %w", err)
+	}
+
+	m.regionPool = map[string]uint32{}
+	m.vectorIndex = [VectorIndexCols][VectorIndexRows]VectorIndexBlock{}
+
+	if err := m.initDbHeader(); err != nil {
+		return fmt.Errorf("init db header: %w", err)
+	}
+
+	if err := m.Start(); err != nil {
+		return fmt.Errorf("rebuild from segments: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,152 @@
+// Copyright 2022 The Ip2Region Authors. All rights reserved.
+// Use of this source code is governed by a Apache2.0-style
+// license that can be found in the LICENSE file.
+
+package xdb
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSpliceSegmentsTrimsAndInserts(t *testing.T) {
+	var segs = []*Segment{
+		{StartIP: 0, EndIP: 99, Region: "a"},
+		{StartIP: 100, EndIP: 199, Region: "b"},
+		{StartIP: 200, EndIP: 299, Region: "c"},
+	}
+
+	// overlaps the tail of "a", all of "b" and the head of "c".
+	var got = spliceSegments(segs, 50, 249, &Segment{StartIP: 50, EndIP: 249, Region: "new"})
+
+	var want = []struct {
+		start, end uint32
+		region     string
+	}{
+		{0, 49, "a"},
+		{50, 249, "new"},
+		{250, 299, "c"},
+	}
+
+	if len(got) != len(want) {
+		t.Fatalf("got %d segments, want %d: %+v", len(got), len(want), got)
+	}
+	for i, w := range want {
+		if got[i].StartIP != w.start || got[i].EndIP != w.end || got[i].Region != w.region {
+			t.Fatalf("segment %d = {%d,%d,%s}, want {%d,%d,%s}", i, got[i].StartIP, got[i].EndIP, got[i].Region, w.start, w.end, w.region)
+		}
+	}
+}
+
+func TestSpliceSegmentsDeleteLeavesGap(t *testing.T) {
+	var segs = []*Segment{
+		{StartIP: 0, EndIP: 99, Region: "a"},
+		{StartIP: 100, EndIP: 199, Region: "b"},
+	}
+
+	var got = spliceSegments(segs, 50, 149, nil)
+
+	var want = []struct {
+		start, end uint32
+		region     string
+	}{
+		{0, 49, "a"},
+		{150, 199, "b"},
+	}
+
+	if len(got) != len(want) {
+		t.Fatalf("got %d segments, want %d: %+v", len(got), len(want), got)
+	}
+	for i, w := range want {
+		if got[i].StartIP != w.start || got[i].EndIP != w.end || got[i].Region != w.region {
+			t.Fatalf("segment %d = {%d,%d,%s}, want {%d,%d,%s}", i, got[i].StartIP, got[i].EndIP, got[i].Region, w.start, w.end, w.region)
+		}
+	}
+}
+
+// TestOpenMakerUpsertCompactRoundTrip builds a small xdb, patches it through
+// OpenMaker+Upsert, and checks the file is still fully readable afterwards -
+// a regression test for appendRegion once having clobbered the live segment
+// index instead of growing past the real end of the file.
+func TestOpenMakerUpsertCompactRoundTrip(t *testing.T) {
+	var dir = t.TempDir()
+	var srcPath = filepath.Join(dir, "src.txt")
+	var dstPath = filepath.Join(dir, "test.xdb")
+
+	var src = "0.0.0.0|0.0.0.255|China|Region1\n" +
+		"0.0.1.0|255.255.255.255|China|Region2\n"
+	if err := os.WriteFile(srcPath, []byte(src), 0644); err != nil {
+		t.Fatalf("write src file: %v", err)
+	}
+
+	maker, err := NewMaker(IndexPolicy(0), AF_INET, srcPath, dstPath)
+	if err != nil {
+		t.Fatalf("NewMaker: %v", err)
+	}
+	if err = maker.Init(); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+	if err = maker.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	if err = maker.End(); err != nil {
+		t.Fatalf("End: %v", err)
+	}
+
+	before, err := os.ReadFile(dstPath)
+	if err != nil {
+		t.Fatalf("read dst before upsert: %v", err)
+	}
+
+	m2, err := OpenMaker(dstPath)
+	if err != nil {
+		t.Fatalf("OpenMaker: %v", err)
+	}
+
+	if err = m2.Upsert(1<<24, 1<<24+255, "China|Region3"); err != nil {
+		t.Fatalf("Upsert: %v", err)
+	}
+
+	// Upsert may only grow the file: every byte of the original xdb,
+	// segment index included, must still be in place.
+	patched, err := os.ReadFile(dstPath)
+	if err != nil {
+		t.Fatalf("read dst after upsert: %v", err)
+	}
+	if len(patched) < len(before) || !bytes.Equal(patched[:len(before)], before) {
+		t.Fatalf("Upsert modified the existing %d bytes of the xdb", len(before))
+	}
+
+	if err = m2.Compact(); err != nil {
+		t.Fatalf("Compact: %v", err)
+	}
+	if err = m2.End(); err != nil {
+		t.Fatalf("End: %v", err)
+	}
+
+	after, err := os.ReadFile(dstPath)
+	if err != nil {
+		t.Fatalf("read dst after compact: %v", err)
+	}
+	if len(after) == 0 {
+		t.Fatalf("compacted file is empty")
+	}
+
+	m3, err := OpenMaker(dstPath)
+	if err != nil {
+		t.Fatalf("re-OpenMaker after compact: %v", err)
+	}
+	defer func() { _ = m3.End() }()
+
+	var foundNewRegion bool
+	for _, seg := range m3.segments {
+		if seg.Region == "China|Region3" {
+			foundNewRegion = true
+		}
+	}
+	if !foundNewRegion {
+		t.Fatalf("expected the upserted region to survive Compact, segments: %+v", m3.segments)
+	}
+}
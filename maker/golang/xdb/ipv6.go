@@ -0,0 +1,272 @@
+// Copyright 2022 The Ip2Region Authors. All rights reserved.
+// Use of this source code is governed by a Apache2.0-style
+// license that can be found in the LICENSE file.
+
+// ----
+// ip2region database v3.0 structure (IPv6 support)
+//
+// the v3 layout keeps the same four regions as v2 (header, vector index,
+// data payload, segment index) but widens every ip field from 4 bytes to
+// 16 bytes so that AF_INET6 segments can be indexed. the vector index
+// itself stays a fixed 256x256 table of VectorIndexBlock: the row/col are
+// keyed off the two most-significant bytes of the ip (PrefixByte0/1 below),
+// same trick as v2's `(ip>>24)&0xFF, (ip>>16)&0xFF`, just applied to the
+// first two bytes of the 16-byte address instead of a shifted uint32.
+
+package xdb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+)
+
+// AddressFamily selects the ip width a Maker indexes: AF_INET (v2, 4 bytes)
+// or AF_INET6 (v3, 16 bytes).
+type AddressFamily int
+
+const (
+	AF_INET AddressFamily = iota
+	AF_INET6
+)
+
+func (f AddressFamily) String() string {
+	switch f {
+	case AF_INET:
+		return "AF_INET"
+	case AF_INET6:
+		return "AF_INET6"
+	default:
+		return "unknown"
+	}
+}
+
+// byte width of an ip address for the given family.
+func (f AddressFamily) IPLength() int {
+	if f == AF_INET6 {
+		return 16
+	}
+	return 4
+}
+
+// PrefixByte0 and PrefixByte1 pick which bytes of a 16-byte address key the
+// 256x256 vector index: the two most-significant bytes. they are constants,
+// so the split is fixed; a Maker has no option to key on other bytes.
+const (
+	PrefixByte0 = 0
+	PrefixByte1 = 1
+)
+
+// CheckIP6 parses a textual IPv6 address (or an IPv4-mapped one) into its
+// 16-byte big-endian representation. mirrors CheckIP's error style.
+func CheckIP6(ip string) ([16]byte, error) {
+	var buf [16]byte
+
+	parsed := net.ParseIP(strings.TrimSpace(ip))
+	if parsed == nil {
+		return buf, fmt.Errorf("invalid ip address `%s`", ip)
+	}
+
+	v6 := parsed.To16()
+	if v6 == nil {
+		return buf, fmt.Errorf("invalid ipv6 address `%s`", ip)
+	}
+
+	copy(buf[:], v6)
+	return buf, nil
+}
+
+// Segment6 is the IPv6 analogue of Segment: a closed [StartIP, EndIP] range
+// mapped to a region string.
+type Segment6 struct {
+	StartIP [16]byte
+	EndIP   [16]byte
+	Region  string
+}
+
+func (s *Segment6) String() string {
+	return fmt.Sprintf("%s|%s|%s", net.IP(s.StartIP[:]).String(), net.IP(s.EndIP[:]).String(), s.Region)
+}
+
+// Split breaks the segment on PrefixByte0/PrefixByte1 boundaries so that
+// every resulting sub-segment falls within a single vector index super
+// block, the same contract Segment.Split offers for v2.
+func (s *Segment6) Split() []*Segment6 {
+	if s.StartIP[PrefixByte0] == s.EndIP[PrefixByte0] && s.StartIP[PrefixByte1] == s.EndIP[PrefixByte1] {
+		return []*Segment6{s}
+	}
+
+	var segList []*Segment6
+	var sPtr = s
+	for {
+		var blockEnd [16]byte
+		copy(blockEnd[:], sPtr.StartIP[:])
+		for i := PrefixByte1 + 1; i < 16; i++ {
+			blockEnd[i] = 0xFF
+		}
+
+		if bytesLess(blockEnd, sPtr.EndIP) {
+			segList = append(segList, &Segment6{StartIP: sPtr.StartIP, EndIP: blockEnd, Region: sPtr.Region})
+			var nextStart [16]byte
+			copy(nextStart[:], blockEnd[:])
+			incrIP(&nextStart)
+			sPtr = &Segment6{StartIP: nextStart, EndIP: sPtr.EndIP, Region: sPtr.Region}
+		} else {
+			segList = append(segList, &Segment6{StartIP: sPtr.StartIP, EndIP: sPtr.EndIP, Region: sPtr.Region})
+			break
+		}
+	}
+
+	return segList
+}
+
+func bytesLess(a, b [16]byte) bool {
+	for i := 0; i < 16; i++ {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return false
+}
+
+func incrIP(ip *[16]byte) {
+	for i := 15; i >= 0; i-- {
+		ip[i]++
+		if ip[i] != 0 {
+			return
+		}
+	}
+}
+
+// SegmentIndexBlock6 is the v3 segment index entry: 16-byte start/end ip
+// instead of v2's 4-byte uint32 pair, same trailing data length/ptr.
+type SegmentIndexBlock6 struct {
+	StartIP [16]byte
+	EndIP   [16]byte
+	DataLen uint16
+	DataPtr uint32
+}
+
+const SegmentIndexBlock6Size = 16 + 16 + 2 + 4
+
+func (s *SegmentIndexBlock6) Encode() []byte {
+	var buff = make([]byte, SegmentIndexBlock6Size)
+	copy(buff, s.StartIP[:])
+	copy(buff[16:], s.EndIP[:])
+	binary.LittleEndian.PutUint16(buff[32:], s.DataLen)
+	binary.LittleEndian.PutUint32(buff[34:], s.DataPtr)
+	return buff
+}
+
+// startV6 is the AF_INET6 counterpart of Maker.Start: same three-pass
+// layout (region payload, segment index, vector index) but built from
+// Segment6/SegmentIndexBlock6 instead of the v2, 4-byte-ip types.
+func (m *Maker) startV6() error {
+	if len(m.segments6) < 1 {
+		return fmt.Errorf("empty segment list")
+	}
+
+	// 1, write all the region/data to the binary file
+	_, err := m.dstHandle.Seek(int64(HeaderInfoLength+VectorIndexLength), 0)
+	if err != nil {
+		return fmt.Errorf("seek to data first ptr: %w", err)
+	}
+
+	for _, seg := range m.segments6 {
+		_, has := m.regionPool[seg.Region]
+		if has {
+			continue
+		}
+
+		var region = []byte(seg.Region)
+		if len(region) > 0xFFFF {
+			return fmt.Errorf("too long region info `%s`: should be less than %d bytes", seg.Region, 0xFFFF)
+		}
+
+		pos, err := m.dstHandle.Seek(0, 1)
+		if err != nil {
+			return fmt.Errorf("seek to current ptr: %w", err)
+		}
+
+		_, err = m.dstHandle.Write(region)
+		if err != nil {
+			return fmt.Errorf("write region '%s': %w", seg.Region, err)
+		}
+
+		m.regionPool[seg.Region] = uint32(pos)
+	}
+
+	// 2, write the index block and cache the super index block
+	var counter, startIndexPtr, endIndexPtr = 0, int64(-1), int64(-1)
+	for _, seg := range m.segments6 {
+		dataPtr, has := m.regionPool[seg.Region]
+		if !has {
+			return fmt.Errorf("missing ptr cache for region `%s`", seg.Region)
+		}
+
+		var dataLen = len(seg.Region)
+		var segList = seg.Split()
+		for _, s := range segList {
+			pos, err := m.dstHandle.Seek(0, 1)
+			if err != nil {
+				return fmt.Errorf("seek to segment index block: %w", err)
+			}
+
+			var sIndex = &SegmentIndexBlock6{
+				StartIP: s.StartIP,
+				EndIP:   s.EndIP,
+				DataLen: uint16(dataLen),
+				DataPtr: dataPtr,
+			}
+
+			_, err = m.dstHandle.Write(sIndex.Encode())
+			if err != nil {
+				return fmt.Errorf("write segment index for '%s': %w", s.String(), err)
+			}
+
+			m.setVectorIndex6(s.StartIP, uint32(pos))
+			counter++
+
+			if startIndexPtr == -1 {
+				startIndexPtr = pos
+			}
+			endIndexPtr = pos
+		}
+	}
+
+	// synchronized the vector index block
+	_, err = m.dstHandle.Seek(int64(HeaderInfoLength), 0)
+	if err != nil {
+		return fmt.Errorf("seek vector index first ptr: %w", err)
+	}
+
+	for i, l := range m.vectorIndex {
+		for j, c := range l {
+			_, err = m.dstHandle.Write(c.Encode())
+			if err != nil {
+				return fmt.Errorf("write vector index [%d][%d]: %w", i, j, err)
+			}
+		}
+	}
+
+	// synchronized the segment index info
+	var buff = make([]byte, 8)
+	binary.LittleEndian.PutUint32(buff, uint32(startIndexPtr))
+	binary.LittleEndian.PutUint32(buff[4:], uint32(endIndexPtr))
+	_, err = m.dstHandle.Seek(8, 0)
+	if err != nil {
+		return fmt.Errorf("seek segment index ptr: %w", err)
+	}
+
+	_, err = m.dstHandle.Write(buff)
+	if err != nil {
+		return fmt.Errorf("write segment index ptr: %w", err)
+	}
+
+	log.Printf("write done (v6), dataBlocks: %d, indexBlocks: (%d, %d), indexPtr: (%d, %d)",
+		len(m.regionPool), len(m.segments6), counter, startIndexPtr, endIndexPtr)
+
+	return nil
+}
@@ -0,0 +1,100 @@
+// Copyright 2022 The Ip2Region Authors. All rights reserved.
+// Use of this source code is governed by a Apache2.0-style
+// license that can be found in the LICENSE file.
+
+package xdb
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestSegment6SplitStaysWithinSuperBlock is a regression test for a bug
+// where Split clobbered PrefixByte1 while computing a sub-segment's end,
+// so a segment spanning several columns of one row (or several rows) came
+// back as one unsplit piece instead of one piece per (row, col).
+func TestSegment6SplitStaysWithinSuperBlock(t *testing.T) {
+	var cases = []struct {
+		name     string
+		startIP  [16]byte
+		endIP    [16]byte
+		minParts int
+	}{
+		{
+			name:     "multi-column, single row",
+			startIP:  ipv6Bytes(0x01, 0x05, 0, 0),
+			endIP:    ipv6Bytes(0x01, 0x09, 0xFF, 0xFF),
+			minParts: 5,
+		},
+		{
+			name:     "multi-row",
+			startIP:  ipv6Bytes(0x00, 0x01, 0, 0),
+			endIP:    ipv6Bytes(0xFF, 0xFF, 0xFF, 0xFF),
+			minParts: 256,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var seg = &Segment6{StartIP: c.startIP, EndIP: c.endIP, Region: "test"}
+			var parts = seg.Split()
+
+			if len(parts) < c.minParts {
+				t.Fatalf("Split() returned %d parts, want at least %d", len(parts), c.minParts)
+			}
+
+			for i, p := range parts {
+				if p.StartIP[PrefixByte0] != p.EndIP[PrefixByte0] || p.StartIP[PrefixByte1] != p.EndIP[PrefixByte1] {
+					t.Fatalf("part %d spans more than one super block: start=%x end=%x", i, p.StartIP, p.EndIP)
+				}
+			}
+		})
+	}
+}
+
+func ipv6Bytes(row, col, b2, b3 byte) [16]byte {
+	var ip [16]byte
+	ip[PrefixByte0] = row
+	ip[PrefixByte1] = col
+	ip[2] = b2
+	ip[3] = b3
+	return ip
+}
+
+// TestStartV6PopulatesVectorIndexPerColumn builds a small AF_INET6 xdb
+// spanning several columns of one row and checks every column the segment
+// actually covers ends up with a non-zero vector index entry - the
+// observable symptom of the Split bug above (a v3 searcher would report
+// "not found" for any address in a column Split silently skipped).
+func TestStartV6PopulatesVectorIndexPerColumn(t *testing.T) {
+	var dir = t.TempDir()
+	var srcPath = filepath.Join(dir, "src.txt")
+	var dstPath = filepath.Join(dir, "test.xdb")
+
+	var src = "5::0|9:ffff:ffff:ffff:ffff:ffff:ffff:ffff|Region1\n"
+	if err := os.WriteFile(srcPath, []byte(src), 0644); err != nil {
+		t.Fatalf("write src file: %v", err)
+	}
+
+	maker, err := NewMaker(IndexPolicy(0), AF_INET6, srcPath, dstPath)
+	if err != nil {
+		t.Fatalf("NewMaker: %v", err)
+	}
+	if err = maker.Init(); err != nil {
+		t.Fatalf("Init: %v", err)
+	}
+	if err = maker.Start(); err != nil {
+		t.Fatalf("Start: %v", err)
+	}
+	if err = maker.End(); err != nil {
+		t.Fatalf("End: %v", err)
+	}
+
+	for col := 0x05; col <= 0x09; col++ {
+		var block = maker.vectorIndex[0][col]
+		if block.FirstPtr == 0 {
+			t.Fatalf("vectorIndex[0][0x%x] was never populated, FirstPtr=0", col)
+		}
+	}
+}
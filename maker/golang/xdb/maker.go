@@ -59,7 +59,13 @@ import (
 	"time"
 )
 
-const VersionNo = 2
+const VersionV2 = 2
+const VersionV3 = 3
+
+// VersionNo is kept as an alias of VersionV2 for backward compatibility:
+// callers that only ever built AF_INET (v2) dbs can keep referencing it.
+const VersionNo = VersionV2
+
 const HeaderInfoLength = 256
 const VectorIndexRows = 256
 const VectorIndexCols = 256
@@ -70,13 +76,33 @@ type Maker struct {
 	srcHandle *os.File
 	dstHandle *os.File
 
+	family      AddressFamily
 	indexPolicy IndexPolicy
 	segments    []*Segment
+	segments6   []*Segment6
 	regionPool  map[string]uint32
 	vectorIndex [VectorIndexCols][VectorIndexRows]VectorIndexBlock
+
+	// payloadCodec/chunkSize are set via WithPayloadCodec; payloadCodec
+	// stays CodecNone (the zero value) unless a caller opts in, which
+	// keeps Start's output byte-identical to the pre-compression layout.
+	payloadCodec PayloadCodec
+	chunkSize    int
+
+	// appendOffset is the next free payload byte an OpenMaker-ed Maker's
+	// Upsert appends new regions at; unused (left at its zero value) on a
+	// NewMaker-built Maker, which always writes its payload via Start.
+	appendOffset int64
+
+	// bloomBitsPerKey > 0 turns on the negative-lookup filter block, set
+	// via WithBloomFilter; 0 (the default) leaves the block out.
+	bloomBitsPerKey int
 }
 
-func NewMaker(policy IndexPolicy, srcFile string, dstFile string) (*Maker, error) {
+// NewMaker creates a Maker for the given address family. family controls
+// which xdb version gets written: AF_INET produces the v2 (4-byte ip)
+// layout unchanged, AF_INET6 produces the v3 (16-byte ip) layout.
+func NewMaker(policy IndexPolicy, family AddressFamily, srcFile string, dstFile string) (*Maker, error) {
 	// open the source file with READONLY mode
 	srcHandle, err := os.OpenFile(srcFile, os.O_RDONLY, 0600)
 	if err != nil {
@@ -93,8 +119,10 @@ func NewMaker(policy IndexPolicy, srcFile string, dstFile string) (*Maker, error
 		srcHandle: srcHandle,
 		dstHandle: dstHandle,
 
+		family:      family,
 		indexPolicy: policy,
 		segments:    []*Segment{},
+		segments6:   []*Segment6{},
 		regionPool:  map[string]uint32{},
 		vectorIndex: [VectorIndexCols][VectorIndexRows]VectorIndexBlock{},
 	}, nil
@@ -112,7 +140,17 @@ func (m *Maker) initDbHeader() error {
 	var header = make([]byte, 256)
 
 	// 1, version number
-	binary.LittleEndian.PutUint16(header, uint16(VersionNo))
+	var version = VersionV2
+	if m.family == AF_INET6 {
+		version = VersionV3
+	}
+	// payload compression only actually touches the AF_INET write path
+	// (Start itself, not startV6); guard the flag so an AF_INET6 header never claims
+	// a codec/TOC that startV6 didn't write.
+	if m.payloadCodec != CodecNone && m.family != AF_INET6 {
+		version |= CompressedVersionFlag
+	}
+	binary.LittleEndian.PutUint16(header, uint16(version))
 
 	// 2, index policy code
 	binary.LittleEndian.PutUint16(header[2:], uint16(m.indexPolicy))
@@ -126,6 +164,29 @@ func (m *Maker) initDbHeader() error {
 	// 5, index block end ptr
 	binary.LittleEndian.PutUint32(header[12:], uint32(0))
 
+	// 6, address family byte, lets a v3-aware searcher dispatch between the
+	// 4-byte and 16-byte ip layouts without re-deriving it from the version.
+	header[16] = byte(m.family)
+
+	// 7, payload codec id; 0 (CodecNone) means the payload is the flat,
+	// uncompressed run Start has always written and there is no TOC.
+	// forced to CodecNone for AF_INET6, see the version flag comment above.
+	if m.family != AF_INET6 {
+		header[17] = byte(m.payloadCodec)
+	}
+
+	// 8, chunk TOC file offset, patched in once Start has written the TOC.
+	binary.LittleEndian.PutUint32(header[20:], uint32(0))
+
+	// 9, bloom filter directory offset, patched in once Start has written
+	// it; 10, the bitsPerKey policy code a filter-unaware searcher should
+	// ignore - 0 means there is no filter block at all. forced to 0 for
+	// AF_INET6, same as the codec byte above: startV6 doesn't build one.
+	binary.LittleEndian.PutUint32(header[24:], uint32(0))
+	if m.family != AF_INET6 {
+		header[28] = byte(m.bloomBitsPerKey)
+	}
+
 	_, err = m.dstHandle.Write(header)
 	if err != nil {
 		return err
@@ -137,6 +198,7 @@ func (m *Maker) initDbHeader() error {
 func (m *Maker) loadSegments() error {
 	log.Printf("try to load the segments ... ")
 	var last *Segment = nil
+	var last6 *Segment6 = nil
 	var tStart = time.Now()
 
 	var scanner = bufio.NewScanner(m.srcHandle)
@@ -144,12 +206,61 @@ func (m *Maker) loadSegments() error {
 	for scanner.Scan() {
 		var l = strings.TrimSpace(strings.TrimSuffix(scanner.Text(), "\n"))
 		log.Printf("load segment: `%s`", l)
+		if len(l) == 0 {
+			continue
+		}
 
 		var ps = strings.SplitN(l, "|", 3)
 		if len(ps) != 3 {
 			return fmt.Errorf("invalid ip segment line `%s`", l)
 		}
 
+		if len(ps[2]) < 1 {
+			return fmt.Errorf("empty region info in segment line `%s`", l)
+		}
+
+		// a ':' in the start ip marks an IPv6 line; this lets a single
+		// source file mix v4 and v6 entries and still be routed to the
+		// maker that was opened for the matching family.
+		if strings.Contains(ps[0], ":") {
+			if m.family != AF_INET6 {
+				log.Printf("skip ipv6 segment line `%s` in an AF_INET maker", l)
+				continue
+			}
+
+			sip, err := CheckIP6(ps[0])
+			if err != nil {
+				return fmt.Errorf("check start ip `%s`: %s", ps[0], err)
+			}
+
+			eip, err := CheckIP6(ps[1])
+			if err != nil {
+				return fmt.Errorf("check end ip `%s`: %s", ps[1], err)
+			}
+
+			if bytesLess(eip, sip) {
+				return fmt.Errorf("start ip(%s) should not be greater than end ip(%s)", ps[0], ps[1])
+			}
+
+			var seg = &Segment6{StartIP: sip, EndIP: eip, Region: ps[2]}
+			if last6 != nil {
+				var nextStart = last6.EndIP
+				incrIP(&nextStart)
+				if nextStart != seg.StartIP {
+					return fmt.Errorf("discontinuous data segment: last.eip+1 != seg.sip(%s)", ps[0])
+				}
+			}
+
+			m.segments6 = append(m.segments6, seg)
+			last6 = seg
+			continue
+		}
+
+		if m.family != AF_INET {
+			log.Printf("skip ipv4 segment line `%s` in an AF_INET6 maker", l)
+			continue
+		}
+
 		sip, err := CheckIP(ps[0])
 		if err != nil {
 			return fmt.Errorf("check start ip `%s`: %s", ps[0], err)
@@ -164,10 +275,6 @@ func (m *Maker) loadSegments() error {
 			return fmt.Errorf("start ip(%s) should not be greater than end ip(%s)", ps[0], ps[1])
 		}
 
-		if len(ps[2]) < 1 {
-			return fmt.Errorf("empty region info in segment line `%s`", l)
-		}
-
 		var seg = &Segment{
 			StartIP: sip,
 			EndIP:   eip,
@@ -185,7 +292,7 @@ func (m *Maker) loadSegments() error {
 		last = seg
 	}
 
-	log.Printf("all segments loaded, length: %d, elapsed: %s", len(m.segments), time.Since(tStart))
+	log.Printf("all segments loaded, v4: %d, v6: %d, elapsed: %s", len(m.segments), len(m.segments6), time.Since(tStart))
 	return nil
 }
 
@@ -217,19 +324,100 @@ func (m *Maker) setVectorIndex(ip uint32, ptr uint32) {
 	}
 }
 
+// refresh the vector index of the specified ipv6 address, keyed off the
+// same two prefix bytes Segment6.Split breaks on.
+func (m *Maker) setVectorIndex6(ip [16]byte, ptr uint32) {
+	var viBlock = &m.vectorIndex[ip[PrefixByte0]][ip[PrefixByte1]]
+	if viBlock.FirstPtr == 0 {
+		viBlock.FirstPtr = ptr
+		viBlock.LastPtr = ptr + SegmentIndexBlock6Size
+	} else {
+		viBlock.LastPtr = ptr + SegmentIndexBlock6Size
+	}
+}
+
 // Start to make the binary file
 func (m *Maker) Start() error {
+	if m.family == AF_INET6 {
+		if m.payloadCodec != CodecNone {
+			return fmt.Errorf("payload compression (WithPayloadCodec) is not supported for AF_INET6 yet")
+		}
+		if m.bloomBitsPerKey > 0 {
+			return fmt.Errorf("bloom filter block (WithBloomFilter) is not supported for AF_INET6 yet")
+		}
+		return m.startV6()
+	}
+
 	if len(m.segments) < 1 {
 		return fmt.Errorf("empty segment list")
 	}
 
+	// 0, build and write the (optional) bloom filter block; it sits right
+	// after the vector index, so its size has to be known before the
+	// payload's start ptr can be fixed.
+	var filterBlockOffset = int64(HeaderInfoLength + VectorIndexLength)
+	var filterBlockSize int64
+	if m.bloomBitsPerKey > 0 {
+		var filters = m.buildSuperBlockFilters()
+
+		var directory = make([]byte, filterDirectoryLength)
+		var offset = filterBlockOffset + filterDirectoryLength
+		for i := 0; i < VectorIndexRows; i++ {
+			for j := 0; j < VectorIndexCols; j++ {
+				f, has := filters[superBlockKey{row: uint8(i), col: uint8(j)}]
+				if !has {
+					continue
+				}
+
+				binary.LittleEndian.PutUint32(directory[(i*VectorIndexCols+j)*filterDirectoryEntrySize:], uint32(offset))
+				offset += int64(len(f.bits))
+			}
+		}
+
+		if _, err := m.dstHandle.Seek(filterBlockOffset, 0); err != nil {
+			return fmt.Errorf("seek to filter block start: %w", err)
+		}
+
+		if _, err := m.dstHandle.Write(directory); err != nil {
+			return fmt.Errorf("write filter directory: %w", err)
+		}
+
+		for i := 0; i < VectorIndexRows; i++ {
+			for j := 0; j < VectorIndexCols; j++ {
+				f, has := filters[superBlockKey{row: uint8(i), col: uint8(j)}]
+				if !has {
+					continue
+				}
+
+				if _, err := m.dstHandle.Write(f.bits); err != nil {
+					return fmt.Errorf("write filter [%d][%d]: %w", i, j, err)
+				}
+			}
+		}
+
+		filterBlockSize = offset - filterBlockOffset
+
+		var buff = make([]byte, 4)
+		binary.LittleEndian.PutUint32(buff, uint32(filterBlockOffset))
+		if _, err := m.dstHandle.WriteAt(buff, 24); err != nil {
+			return fmt.Errorf("write filter directory ptr: %w", err)
+		}
+
+		log.Printf("try to write the bloom filter block ... %d super blocks, %d bytes", len(filters), filterBlockSize)
+	}
+
 	// 1, write all the region/data to the binary file
-	_, err := m.dstHandle.Seek(int64(HeaderInfoLength+VectorIndexLength), 0)
+	_, err := m.dstHandle.Seek(filterBlockOffset+filterBlockSize, 0)
 	if err != nil {
 		return fmt.Errorf("seek to data first ptr: %w", err)
 	}
 
 	log.Printf("try to write the data block ... ")
+	var chunker *payloadChunker
+	if m.payloadCodec != CodecNone {
+		chunker = newPayloadChunker(m.payloadCodec, m.chunkSize)
+	}
+
 	for _, seg := range m.segments {
 		log.Printf("try to write region '%s' ... ", seg.Region)
 		ptr, has := m.regionPool[seg.Region]
@@ -243,6 +431,22 @@ func (m *Maker) Start() error {
 			return fmt.Errorf("too long region info `%s`: shoul be less than %d bytes", seg.Region, 0xFFFF)
 		}
 
+		if chunker != nil {
+			chunkID, offset, err := chunker.add(m.dstHandle, region)
+			if err != nil {
+				return fmt.Errorf("chunk region '%s': %w", seg.Region, err)
+			}
+
+			ptr, err := encodeChunkPtr(chunkID, offset)
+			if err != nil {
+				return fmt.Errorf("encode chunk ptr for '%s': %w", seg.Region, err)
+			}
+
+			m.regionPool[seg.Region] = ptr
+			log.Printf(" --[Added] to chunk=%d, offset=%d", chunkID, offset)
+			continue
+		}
+
 		// get the first ptr of the next region
 		pos, err := m.dstHandle.Seek(0, 1)
 		if err != nil {
@@ -258,6 +462,25 @@ func (m *Maker) Start() error {
 		log.Printf(" --[Added] with ptr=%d", pos)
 	}
 
+	var tocOffset int64
+	if chunker != nil {
+		if err = chunker.flush(m.dstHandle); err != nil {
+			return fmt.Errorf("flush last chunk: %w", err)
+		}
+
+		tocOffset, err = m.dstHandle.Seek(0, 1)
+		if err != nil {
+			return fmt.Errorf("seek to chunk TOC start: %w", err)
+		}
+
+		log.Printf("try to write the chunk TOC (%d chunks) ... ", len(chunker.toc))
+		for _, e := range chunker.toc {
+			if _, err = m.dstHandle.Write(e.Encode()); err != nil {
+				return fmt.Errorf("write chunk TOC entry: %w", err)
+			}
+		}
+	}
+
 	// 2, write the index block and cache the super index block
 	log.Printf("try to write the segment index block ... ")
 	var counter, startIndexPtr, endIndexPtr = 0, int64(-1), int64(-1)
@@ -337,6 +560,21 @@ func (m *Maker) Start() error {
 		return fmt.Errorf("write segment index ptr: %w", err)
 	}
 
+	// synchronized the chunk TOC ptr, only meaningful when payloadCodec != CodecNone
+	if chunker != nil {
+		_, err = m.dstHandle.Seek(20, 0)
+		if err != nil {
+			return fmt.Errorf("seek chunk TOC ptr: %w", err)
+		}
+
+		var tocBuff = make([]byte, 4)
+		binary.LittleEndian.PutUint32(tocBuff, uint32(tocOffset))
+		_, err = m.dstHandle.Write(tocBuff)
+		if err != nil {
+			return fmt.Errorf("write chunk TOC ptr: %w", err)
+		}
+	}
+
 	log.Printf("write done, dataBlocks: %d, indexBlocks: (%d, %d), indexPtr: (%d, %d)",
 		len(m.regionPool), len(m.segments), counter, startIndexPtr, endIndexPtr)
 
@@ -349,9 +587,13 @@ func (m *Maker) End() error {
 		return err
 	}
 
-	err = m.srcHandle.Close()
-	if err != nil {
-		return err
+	// srcHandle is nil for a Maker opened via OpenMaker - there is no
+	// plain-text source to close in that case.
+	if m.srcHandle != nil {
+		err = m.srcHandle.Close()
+		if err != nil {
+			return err
+		}
 	}
 
 	return nil